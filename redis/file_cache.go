@@ -0,0 +1,322 @@
+package redis
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/journeymidnight/yig/helper"
+)
+
+// defaultFileChunkSize is used when helper.CONFIG.RedisFileCacheChunkSize is
+// unset. It caps how much of a file lives in a single Redis string, well
+// under Redis's 512MB string limit.
+const defaultFileChunkSize = 1 << 20 // 1MB
+
+// chunkGCGracePeriod bounds how long a superseded epoch's chunks are kept
+// around after a SetBytes flips `:meta` to a newer one. A concurrent
+// GetBytes that read the old epoch off `:meta` just before the flip may
+// still have that epoch's chunk keys queued in its GETRANGE pipeline;
+// expiring rather than deleting them outright gives that read a window to
+// land before the chunks disappear underneath it.
+const chunkGCGracePeriod = 5 * time.Second
+
+// defaultFileChunkTTL is used when helper.CONFIG.RedisFileCacheChunkTTL is
+// unset.
+const defaultFileChunkTTL = 24 * time.Hour
+
+// fileChunkTTL bounds how long any chunk key can live in Redis, regardless
+// of whether it's ever explicitly garbage-collected. SetBytes only GCs the
+// one oldMeta epoch it itself observed, so two concurrent SetBytes calls
+// for the same key that both read the same oldMeta (one writing epoch N+1,
+// the other N+2) leave the loser's epoch an orphan: it's never anyone's
+// oldMeta again, so the lazy GC in SetBytes never reaches it. This TTL is
+// the backstop that reclaims it anyway.
+func fileChunkTTL() time.Duration {
+	if helper.CONFIG.RedisFileCacheChunkTTL > 0 {
+		return time.Duration(helper.CONFIG.RedisFileCacheChunkTTL) * time.Second
+	}
+	return defaultFileChunkTTL
+}
+
+// fileMeta records how a file was split into chunks so GetBytes/DeleteBytes
+// know which chunk keys to address without guessing. epoch scopes the chunk
+// keys a given SetBytes wrote: chunks are never overwritten in place, so a
+// reader using a given epoch's meta can never observe a write in progress
+// under a different, still-being-written epoch.
+type fileMeta struct {
+	length    int64
+	chunkSize int64
+	epoch     int64
+}
+
+func fileChunkSize() int64 {
+	if helper.CONFIG.RedisFileCacheChunkSize > 0 {
+		return helper.CONFIG.RedisFileCacheChunkSize
+	}
+	return defaultFileChunkSize
+}
+
+func fileMetaKey(key string) string {
+	return FileTable.String() + key + ":meta"
+}
+
+func fileChunkKey(key string, epoch, chunkIndex int64) string {
+	return FileTable.String() + key + ":" + strconv.FormatInt(epoch, 10) + ":" + strconv.FormatInt(chunkIndex, 10)
+}
+
+func chunkCount(length, chunkSize int64) int64 {
+	if length <= 0 {
+		return 0
+	}
+	return (length + chunkSize - 1) / chunkSize
+}
+
+func encodeFileMeta(m fileMeta) string {
+	return strconv.FormatInt(m.length, 10) + ":" + strconv.FormatInt(m.chunkSize, 10) + ":" + strconv.FormatInt(m.epoch, 10)
+}
+
+// normalizeRange applies GETRANGE's from-the-end offset convention (a
+// negative offset counts back from length) to start and end, then clamps
+// both to [0, length). ok is false when the resulting range is empty (the
+// object is empty, or start is past end), in which case start/end are
+// meaningless and the caller should return no bytes without hitting Redis.
+func normalizeRange(start, end, length int64) (normStart, normEnd int64, ok bool) {
+	if start < 0 {
+		start += length
+		if start < 0 {
+			start = 0
+		}
+	}
+	if end < 0 {
+		end += length
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || end < 0 {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func decodeFileMeta(s string) (fileMeta, error) {
+	parts := strings.SplitN(s, ":", 3)
+	if len(parts) != 3 {
+		return fileMeta{}, helper.ErrInternalError
+	}
+	length, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	chunkSize, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	epoch, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return fileMeta{}, err
+	}
+	return fileMeta{length: length, chunkSize: chunkSize, epoch: epoch}, nil
+}
+
+func getFileMeta(ctx context.Context, key string) (*fileMeta, error) {
+	encoded, err := client.Get(ctx, fileMetaKey(key)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+	meta, err := decodeFileMeta(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// GetBytes fetches the `[start, end]` (inclusive) range of the file stored
+// under key, reading only the chunks that intersect the range via a single
+// pipelined GETRANGE batch instead of materializing the whole object. Only
+// concurrent requests for the same range are coalesced (coalescedFetch) —
+// the result isn't kept in the in-process metadata LRU, since file ranges
+// vary per request and can be arbitrarily large.
+func GetBytes(ctx context.Context, key string, start int64, end int64) ([]byte, error) {
+	return coalescedFetch(byteRangeCacheKey(key, start, end), func() ([]byte, error) {
+		var result []byte
+		err := CacheCircuit.Execute(
+			ctx,
+			func(ctx context.Context) (err error) {
+				meta, err := getFileMeta(ctx, key)
+				if err != nil {
+					return err
+				}
+				if meta == nil {
+					return nil
+				}
+
+				var ok bool
+				start, end, ok = normalizeRange(start, end, meta.length)
+				if !ok {
+					return nil
+				}
+
+				firstChunk := start / meta.chunkSize
+				lastChunk := end / meta.chunkSize
+
+				pipe := client.Pipeline()
+				cmds := make([]*redis.StringCmd, 0, lastChunk-firstChunk+1)
+				for i := firstChunk; i <= lastChunk; i++ {
+					chunkStart := int64(0)
+					chunkEnd := meta.chunkSize - 1
+					if i == firstChunk {
+						chunkStart = start % meta.chunkSize
+					}
+					if i == lastChunk {
+						chunkEnd = end % meta.chunkSize
+					}
+					cmds = append(cmds, pipe.GetRange(ctx, fileChunkKey(key, meta.epoch, i), chunkStart, chunkEnd))
+				}
+				if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+					helper.ErrorIf(err, "Cmd: %s. Key: %s.", "GETRANGE (pipeline)", FileTable.String()+key)
+					return err
+				}
+
+				result = make([]byte, 0, end-start+1)
+				for _, cmd := range cmds {
+					chunk, err := cmd.Result()
+					if err != nil && err != redis.Nil {
+						return err
+					}
+					result = append(result, chunk...)
+				}
+				return nil
+			},
+			nil,
+		)
+		return result, err
+	})
+}
+
+// SetBytes splits value into fixed-size chunks (see fileChunkSize) stored
+// under a fresh epoch's fileChunkKey(key, epoch, i), plus a small metadata
+// key recording the total length, chunk size and epoch, so the file can be
+// read back in ranges without a single Redis string holding the whole
+// object. Chunks are never overwritten in place: each call writes under a
+// new epoch and only flips `:meta` to it once every chunk has been
+// acknowledged, so a concurrent GetBytes reading the old epoch's meta can
+// never see a blend of old and new bytes. The chunk writes and the meta
+// write are issued as two separate pipelines rather than one: client is a
+// redis.UniversalClient, and in Cluster mode a single Pipeline() splits
+// across per-node sub-pipelines with no ordering guarantee between them, so
+// folding the meta write into the chunk pipeline would let it land before
+// some chunks on a different node. Waiting for the chunk pipeline's Exec to
+// return before issuing the meta Set keeps the happens-before relationship
+// regardless of topology. The previous epoch's chunks are garbage-collected
+// lazily, on the next SetBytes for this key: rather than an immediate Del
+// (which would race a GetBytes that read the old epoch off `:meta` just
+// before this call's flip), GC expires them after chunkGCGracePeriod
+// instead. Every chunk is also written with fileChunkTTL regardless, as a
+// backstop against an epoch that's never anyone's oldMeta again (two
+// concurrent SetBytes calls racing off the same oldMeta) and so would
+// otherwise never be reached by that GC at all.
+func SetBytes(ctx context.Context, key string, value []byte) (err error) {
+	return CacheCircuit.Execute(
+		ctx,
+		func(ctx context.Context) (err error) {
+			oldMeta, err := getFileMeta(ctx, key)
+			if err != nil {
+				return err
+			}
+
+			chunkSize := fileChunkSize()
+			epoch := time.Now().UnixNano()
+			meta := fileMeta{length: int64(len(value)), chunkSize: chunkSize, epoch: epoch}
+			numChunks := chunkCount(meta.length, chunkSize)
+			chunkTTL := fileChunkTTL()
+
+			pipe := client.Pipeline()
+			for i := int64(0); i < numChunks; i++ {
+				chunkStart := i * chunkSize
+				chunkEnd := chunkStart + chunkSize
+				if chunkEnd > meta.length {
+					chunkEnd = meta.length
+				}
+				pipe.Set(ctx, fileChunkKey(key, epoch, i), value[chunkStart:chunkEnd], chunkTTL)
+			}
+			if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+				helper.ErrorIf(err, "Cmd: %s. Key: %s.", "SET (chunked)", FileTable.String()+key)
+				return err
+			}
+
+			// Only issued once every chunk above is confirmed written, so
+			// the new epoch never becomes visible to readers ahead of its
+			// own chunks landing, even when chunks and meta land on
+			// different Cluster nodes.
+			err = client.Set(ctx, fileMetaKey(key), encodeFileMeta(meta), 0).Err()
+			if err != nil && err != redis.Nil {
+				helper.ErrorIf(err, "Cmd: %s. Key: %s.", "SET (meta)", FileTable.String()+key)
+				return err
+			}
+
+			// The previous epoch's chunks are no longer reachable through
+			// `:meta`, but aren't deleted outright: a GetBytes that read
+			// the old epoch off `:meta` just before this flip may still
+			// have those chunk keys queued in its GETRANGE pipeline, and an
+			// immediate Del would race it into splicing an empty chunk into
+			// its result. Expiring them after chunkGCGracePeriod gives that
+			// read time to land first. Best-effort: a failure here leaves
+			// them to expire via fileChunkTTL, since the next SetBytes only
+			// sees this call's epoch as its oldMeta.
+			if oldMeta != nil {
+				gcPipe := client.Pipeline()
+				oldChunks := chunkCount(oldMeta.length, oldMeta.chunkSize)
+				for i := int64(0); i < oldChunks; i++ {
+					gcPipe.Expire(ctx, fileChunkKey(key, oldMeta.epoch, i), chunkGCGracePeriod)
+				}
+				if _, gcErr := gcPipe.Exec(ctx); gcErr != nil && gcErr != redis.Nil {
+					helper.ErrorIf(gcErr, "Cannot garbage-collect old redis file cache chunks. Key: %s. Epoch: %d.", FileTable.String()+key, oldMeta.epoch)
+				}
+			}
+
+			return nil
+		},
+		nil,
+	)
+}
+
+// DeleteBytes removes the metadata key and the chunks of the epoch it
+// points to, with the deletes pipelined into one batch after `:meta` is
+// read. Chunks of superseded epochs are not deleted here; they are left to
+// expire via chunkGCGracePeriod or fileChunkTTL.
+func DeleteBytes(ctx context.Context, key string) (err error) {
+	return CacheCircuit.Execute(
+		ctx,
+		func(ctx context.Context) (err error) {
+			meta, err := getFileMeta(ctx, key)
+			if err != nil {
+				return err
+			}
+			if meta == nil {
+				return nil
+			}
+
+			pipe := client.Pipeline()
+			pipe.Del(ctx, fileMetaKey(key))
+			numChunks := chunkCount(meta.length, meta.chunkSize)
+			for i := int64(0); i < numChunks; i++ {
+				pipe.Del(ctx, fileChunkKey(key, meta.epoch, i))
+			}
+
+			_, err = pipe.Exec(ctx)
+			if err == redis.Nil {
+				return nil
+			}
+			helper.ErrorIf(err, "Cmd: %s. Key: %s.", "DEL (chunked)", FileTable.String()+key)
+			return err
+		},
+		nil,
+	)
+}
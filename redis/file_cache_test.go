@@ -0,0 +1,81 @@
+package redis
+
+import "testing"
+
+func TestChunkCount(t *testing.T) {
+	cases := []struct {
+		length, chunkSize int64
+		want              int64
+	}{
+		{length: 0, chunkSize: 100, want: 0},
+		{length: -1, chunkSize: 100, want: 0},
+		{length: 1, chunkSize: 100, want: 1},
+		{length: 100, chunkSize: 100, want: 1},
+		{length: 101, chunkSize: 100, want: 2},
+		{length: 250, chunkSize: 100, want: 3},
+	}
+	for _, c := range cases {
+		if got := chunkCount(c.length, c.chunkSize); got != c.want {
+			t.Errorf("chunkCount(%d, %d) = %d, want %d", c.length, c.chunkSize, got, c.want)
+		}
+	}
+}
+
+func TestFileMetaRoundTrip(t *testing.T) {
+	want := fileMeta{length: 12345, chunkSize: 1 << 20, epoch: 1690000000000000000}
+	got, err := decodeFileMeta(encodeFileMeta(want))
+	if err != nil {
+		t.Fatalf("decodeFileMeta: %v", err)
+	}
+	if got != want {
+		t.Errorf("decodeFileMeta(encodeFileMeta(%+v)) = %+v", want, got)
+	}
+}
+
+func TestDecodeFileMetaMalformed(t *testing.T) {
+	cases := []string{
+		"",
+		"123",
+		"123:456",
+		"123:456:abc",
+		"abc:456:789",
+	}
+	for _, s := range cases {
+		if _, err := decodeFileMeta(s); err == nil {
+			t.Errorf("decodeFileMeta(%q): expected error, got nil", s)
+		}
+	}
+}
+
+func TestNormalizeRange(t *testing.T) {
+	cases := []struct {
+		name               string
+		start, end, length int64
+		wantStart, wantEnd int64
+		wantOK             bool
+	}{
+		{name: "simple", start: 0, end: 9, length: 100, wantStart: 0, wantEnd: 9, wantOK: true},
+		{name: "end clamped to length", start: 0, end: 999, length: 100, wantStart: 0, wantEnd: 99, wantOK: true},
+		{name: "negative end counts from end", start: 0, end: -1, length: 100, wantStart: 0, wantEnd: 99, wantOK: true},
+		{name: "negative start counts from end", start: -10, end: -1, length: 100, wantStart: 90, wantEnd: 99, wantOK: true},
+		{name: "negative start past beginning clamps to 0", start: -1000, end: 9, length: 100, wantStart: 0, wantEnd: 9, wantOK: true},
+		{name: "start past end is empty", start: 50, end: 10, length: 100, wantOK: false},
+		{name: "empty object", start: 0, end: 9, length: 0, wantOK: false},
+		{name: "negative end past beginning is empty", start: 0, end: -1000, length: 100, wantOK: false},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			gotStart, gotEnd, gotOK := normalizeRange(c.start, c.end, c.length)
+			if gotOK != c.wantOK {
+				t.Fatalf("normalizeRange(%d, %d, %d) ok = %v, want %v", c.start, c.end, c.length, gotOK, c.wantOK)
+			}
+			if !c.wantOK {
+				return
+			}
+			if gotStart != c.wantStart || gotEnd != c.wantEnd {
+				t.Errorf("normalizeRange(%d, %d, %d) = (%d, %d), want (%d, %d)",
+					c.start, c.end, c.length, gotStart, gotEnd, c.wantStart, c.wantEnd)
+			}
+		})
+	}
+}
@@ -0,0 +1,185 @@
+package redis
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/sync/singleflight"
+
+	"github.com/journeymidnight/yig/helper"
+)
+
+// localEntry is what's stored in the in-process LRU tier in front of Redis.
+// Every entry carries expiresAt: positive entries use positiveCacheTTL as a
+// staleness backstop independent of pub/sub invalidation, and negative
+// entries (a confirmed miss, so repeated lookups of keys that don't exist —
+// e.g. a bucket name typo hammered by a client — don't keep round-tripping
+// to Redis) use the shorter, configurable negativeCacheTTL.
+type localEntry struct {
+	value     []byte
+	negative  bool
+	expiresAt time.Time
+}
+
+var (
+	localCache *lru.Cache
+	fetchGroup singleflight.Group
+
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheCoalesced uint64
+	cacheNegative  uint64
+)
+
+// initLocalCache builds the in-process LRU tier and wires it up to the
+// pub/sub invalidation subscriber so entries are dropped the moment another
+// yig instance mutates the underlying key, not just on LRU pressure.
+func initLocalCache() {
+	size := helper.CONFIG.RedisLocalCacheSize
+	if size <= 0 {
+		localCache = nil
+		return
+	}
+
+	c, err := lru.New(size)
+	if err != nil {
+		helper.ErrorIf(err, "Cannot create redis local cache.")
+		return
+	}
+	localCache = c
+
+	for _, table := range MetadataTables {
+		table := table
+		RegisterInvalidationHandler(table, func(key string) {
+			localCache.Remove(table.String() + key)
+		})
+	}
+}
+
+func negativeCacheTTL() time.Duration {
+	if helper.CONFIG.RedisNegativeCacheTTL <= 0 {
+		return 0
+	}
+	return time.Duration(helper.CONFIG.RedisNegativeCacheTTL) * time.Second
+}
+
+// positiveCacheTTL mirrors the 30s `EX` that Set() puts on the underlying
+// Redis key. Freshness of a positive local entry shouldn't depend solely on
+// an Invalid() pub/sub message arriving — that channel is best-effort and
+// goes quiet for the duration of any subscriber reconnect — so this TTL
+// bounds how stale a local hit can be even if an invalidation is missed.
+const positiveCacheTTL = 30 * time.Second
+
+// cachedFetch is the shared read path for Get: it checks the local LRU
+// first, then falls through to fetch, coalescing concurrent callers of the
+// same cacheKey via singleflight so a thundering herd on a cold key
+// collapses into a single Redis round-trip. Both hits and misses are kept
+// for a bounded TTL (positiveCacheTTL / negativeCacheTTL) rather than
+// indefinitely, so a local entry can't outlive a missed invalidation.
+//
+// This is for small, genuinely hot metadata values (bucket/object/user
+// entries). File byte ranges go through coalescedFetch instead: they vary
+// per request (Range headers) and can be arbitrarily large, so caching them
+// here would blow an LRU that's sized and bounded for metadata.
+func cachedFetch(cacheKey string, fetch func() ([]byte, error)) ([]byte, error) {
+	if localCache != nil {
+		if v, ok := localCache.Get(cacheKey); ok {
+			entry := v.(localEntry)
+			if time.Now().Before(entry.expiresAt) {
+				atomic.AddUint64(&cacheHits, 1)
+				if entry.negative {
+					atomic.AddUint64(&cacheNegative, 1)
+					return nil, nil
+				}
+				return entry.value, nil
+			}
+			localCache.Remove(cacheKey)
+		}
+	}
+
+	atomic.AddUint64(&cacheMisses, 1)
+	v, err, shared := fetchGroup.Do(cacheKey, func() (interface{}, error) {
+		return fetch()
+	})
+	if shared {
+		atomic.AddUint64(&cacheCoalesced, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, _ := v.([]byte)
+
+	if localCache != nil {
+		if len(value) == 0 {
+			if ttl := negativeCacheTTL(); ttl > 0 {
+				localCache.Add(cacheKey, localEntry{negative: true, expiresAt: time.Now().Add(ttl)})
+			}
+		} else {
+			localCache.Add(cacheKey, localEntry{value: value, expiresAt: time.Now().Add(positiveCacheTTL)})
+		}
+	}
+	return value, nil
+}
+
+func byteRangeCacheKey(key string, start, end int64) string {
+	return fmt.Sprintf("%s%s:%d:%d", FileTable.String(), key, start, end)
+}
+
+// coalescedFetch is the read path for GetBytes: it only coalesces
+// concurrent callers of the same cacheKey via singleflight so a thundering
+// herd on a cold range collapses into one Redis round-trip. Unlike
+// cachedFetch, it never stores the result in localCache — file byte ranges
+// are per-request (Range headers) and can be arbitrarily large, so they
+// don't belong in an LRU sized and bounded for hot metadata entries.
+func coalescedFetch(cacheKey string, fetch func() ([]byte, error)) ([]byte, error) {
+	v, err, shared := fetchGroup.Do(cacheKey, func() (interface{}, error) {
+		return fetch()
+	})
+	if shared {
+		atomic.AddUint64(&cacheCoalesced, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
+	value, _ := v.([]byte)
+	return value, nil
+}
+
+// CacheStats reports the two-level cache counters: hits served from the
+// local LRU, misses that fell through to Redis, Redis round-trips
+// coalesced by singleflight, and hits served from the negative cache.
+func CacheStats() (hits, misses, coalesced, negativeHits uint64) {
+	return atomic.LoadUint64(&cacheHits),
+		atomic.LoadUint64(&cacheMisses),
+		atomic.LoadUint64(&cacheCoalesced),
+		atomic.LoadUint64(&cacheNegative)
+}
+
+// Registering these at package init, rather than from Initialize(), exposes
+// CacheStats() on the default Prometheus registry regardless of when/whether
+// the caller also scrapes yig's other metrics.
+var (
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "yig_redis_local_cache_hits_total",
+		Help: "Local in-process cache hits for redis.Get, including negative-cache hits.",
+	}, func() float64 { return float64(atomic.LoadUint64(&cacheHits)) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "yig_redis_local_cache_misses_total",
+		Help: "Local in-process cache misses for redis.Get that fell through to Redis.",
+	}, func() float64 { return float64(atomic.LoadUint64(&cacheMisses)) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "yig_redis_local_cache_coalesced_total",
+		Help: "Redis round-trips coalesced into one by singleflight.",
+	}, func() float64 { return float64(atomic.LoadUint64(&cacheCoalesced)) })
+
+	_ = promauto.NewCounterFunc(prometheus.CounterOpts{
+		Name: "yig_redis_local_cache_negative_hits_total",
+		Help: "Hits served from the negative (confirmed-miss) cache.",
+	}, func() float64 { return float64(atomic.LoadUint64(&cacheNegative)) })
+)
@@ -0,0 +1,166 @@
+package redis
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// withLocalCache installs a fresh LRU of the given size as localCache for
+// the duration of the test and restores whatever was there before, so tests
+// don't leak state into each other or into a real Initialize() call.
+func withLocalCache(t *testing.T, size int) {
+	t.Helper()
+	prev := localCache
+	if size <= 0 {
+		localCache = nil
+	} else {
+		c, err := lru.New(size)
+		if err != nil {
+			t.Fatalf("lru.New: %v", err)
+		}
+		localCache = c
+	}
+	t.Cleanup(func() { localCache = prev })
+}
+
+func TestCachedFetchDisabledAlwaysFetches(t *testing.T) {
+	withLocalCache(t, 0)
+
+	calls := 0
+	fetch := func() ([]byte, error) {
+		calls++
+		return []byte("value"), nil
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := cachedFetch("k", fetch); err != nil {
+			t.Fatalf("cachedFetch: %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Errorf("fetch called %d times with no local cache, want 3 (every call should fall through)", calls)
+	}
+}
+
+func TestCachedFetchServesFromLocalCacheWithinTTL(t *testing.T) {
+	withLocalCache(t, 16)
+
+	calls := 0
+	fetch := func() ([]byte, error) {
+		calls++
+		return []byte("value"), nil
+	}
+
+	v1, err := cachedFetch("k", fetch)
+	if err != nil {
+		t.Fatalf("cachedFetch: %v", err)
+	}
+	v2, err := cachedFetch("k", fetch)
+	if err != nil {
+		t.Fatalf("cachedFetch: %v", err)
+	}
+
+	if calls != 1 {
+		t.Errorf("fetch called %d times, want 1 (second call should hit the local cache)", calls)
+	}
+	if string(v1) != "value" || string(v2) != "value" {
+		t.Errorf("cachedFetch returned (%q, %q), want (\"value\", \"value\")", v1, v2)
+	}
+}
+
+func TestCachedFetchRefetchesExpiredEntry(t *testing.T) {
+	withLocalCache(t, 16)
+
+	localCache.Add("k", localEntry{value: []byte("stale"), expiresAt: time.Now().Add(-time.Second)})
+
+	calls := 0
+	fetch := func() ([]byte, error) {
+		calls++
+		return []byte("fresh"), nil
+	}
+
+	v, err := cachedFetch("k", fetch)
+	if err != nil {
+		t.Fatalf("cachedFetch: %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("fetch called %d times, want 1 (expired entry should be treated as a miss)", calls)
+	}
+	if string(v) != "fresh" {
+		t.Errorf("cachedFetch returned %q, want \"fresh\"", v)
+	}
+}
+
+func TestCachedFetchNegativeEntryShortCircuits(t *testing.T) {
+	withLocalCache(t, 16)
+
+	localCache.Add("k", localEntry{negative: true, expiresAt: time.Now().Add(time.Minute)})
+
+	calls := 0
+	fetch := func() ([]byte, error) {
+		calls++
+		return []byte("should not be reached"), nil
+	}
+
+	v, err := cachedFetch("k", fetch)
+	if err != nil {
+		t.Fatalf("cachedFetch: %v", err)
+	}
+	if calls != 0 {
+		t.Errorf("fetch called %d times, want 0 (negative entry should short-circuit)", calls)
+	}
+	if v != nil {
+		t.Errorf("cachedFetch returned %q, want nil for a negative hit", v)
+	}
+}
+
+func TestCoalescedFetchCollapsesConcurrentCallers(t *testing.T) {
+	var calls int // guarded by mu
+	var mu sync.Mutex
+	release := make(chan struct{})
+	entered := make(chan struct{})
+
+	fetch := func() ([]byte, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		close(entered)
+		<-release
+		return []byte("value"), nil
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	results := make([][]byte, n)
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			v, err := coalescedFetch("shared-key", fetch)
+			if err != nil {
+				t.Errorf("coalescedFetch: %v", err)
+				return
+			}
+			results[i] = v
+		}()
+	}
+
+	<-entered
+	close(release)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if calls != 1 {
+		t.Errorf("fetch called %d times for %d concurrent callers sharing a key, want 1", calls, n)
+	}
+	for i, v := range results {
+		if string(v) != "value" {
+			t.Errorf("result[%d] = %q, want \"value\"", i, v)
+		}
+	}
+}
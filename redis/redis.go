@@ -4,16 +4,26 @@ import (
 	"strconv"
 
 	"context"
-	redigo "github.com/gomodule/redigo/redis"
-	"github.com/journeymidnight/yig/circuitbreak"
-	"github.com/journeymidnight/yig/helper"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"sync"
 	"time"
+
 	"github.com/cep21/circuit"
+	"github.com/go-redis/redis/v8"
+	"github.com/journeymidnight/yig/circuitbreak"
+	"github.com/journeymidnight/yig/helper"
 )
 
 var (
-	redisPool *redigo.Pool
+	client       redis.UniversalClient
 	CacheCircuit *circuit.Circuit
+
+	invalidHandlersMu sync.Mutex
+	invalidHandlers   = map[RedisDatabase][]func(key string){}
+	invalidPubSub     *redis.PubSub
+	invalidCancel     context.CancelFunc
 )
 
 const InvalidQueueName = "InvalidQueue"
@@ -30,72 +40,169 @@ func (r RedisDatabase) InvalidQueue() string {
 
 const (
 	UserTable    RedisDatabase = iota
-	BucketTable  
-	ObjectTable  
-	FileTable    
-	ClusterTable 
+	BucketTable
+	ObjectTable
+	FileTable
+	ClusterTable
 )
 
 var MetadataTables = []RedisDatabase{UserTable, BucketTable, ObjectTable, ClusterTable}
 var DataTables = []RedisDatabase{FileTable}
 
-func Initialize() {
+// RedisMode selects which topology Initialize() dials against.
+type RedisMode int
+
+const (
+	// ModeSingle dials a single Redis endpoint. This is the default.
+	ModeSingle RedisMode = iota
+	// ModeSentinel asks a set of Sentinels for the current master address
+	// and re-resolves it whenever the client's connection is recycled.
+	ModeSentinel
+	// ModeCluster shards keys across a Redis Cluster, routing by hash slot.
+	ModeCluster
+)
 
-	options := []redigo.DialOption{
-		redigo.DialReadTimeout(time.Duration(helper.CONFIG.RedisReadTimeout) * time.Second),
-		redigo.DialConnectTimeout(time.Duration(helper.CONFIG.RedisConnectTimeout) * time.Second),
-		redigo.DialWriteTimeout(time.Duration(helper.CONFIG.RedisWriteTimeout) * time.Second),
-		redigo.DialKeepAlive(time.Duration(helper.CONFIG.RedisKeepAlive) * time.Second),
+// tlsConfig builds a *tls.Config from the CA/cert/key paths in
+// helper.CONFIG, or nil if TLS dialing wasn't requested.
+func tlsConfig() (*tls.Config, error) {
+	if !helper.CONFIG.RedisUseTLS {
+		return nil, nil
 	}
 
-	if helper.CONFIG.RedisPassword != "" {
-		options = append(options, redigo.DialPassword(helper.CONFIG.RedisPassword))
+	config := &tls.Config{InsecureSkipVerify: helper.CONFIG.RedisTLSInsecureSkipVerify}
+
+	if helper.CONFIG.RedisTLSCAFile != "" {
+		ca, err := ioutil.ReadFile(helper.CONFIG.RedisTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(ca)
+		config.RootCAs = pool
 	}
 
-	df := func() (redigo.Conn, error) {
-		c, err := redigo.Dial("tcp", helper.CONFIG.RedisAddress, options...)
+	if helper.CONFIG.RedisTLSCertFile != "" && helper.CONFIG.RedisTLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(helper.CONFIG.RedisTLSCertFile, helper.CONFIG.RedisTLSKeyFile)
 		if err != nil {
 			return nil, err
 		}
-		return c, nil
+		config.Certificates = []tls.Certificate{cert}
 	}
 
+	return config, nil
+}
+
+func Initialize() {
 	CacheCircuit = circuitbreak.NewCacheCircuit()
-	redisPool = &redigo.Pool{
-			MaxIdle:     helper.CONFIG.RedisPoolMaxIdle,
-			IdleTimeout: time.Duration(helper.CONFIG.RedisPoolIdleTimeout) * time.Second,
-			// Other pool configuration not shown in this example.
-			Dial: df,
+
+	tc, err := tlsConfig()
+	if err != nil {
+		// RedisUseTLS was explicitly requested; a bad CA/cert/key must fail
+		// startup loudly instead of silently falling back to plaintext.
+		helper.ErrorIf(err, "Cannot build redis TLS config.")
+		panic(err)
+	}
+
+	opts := &redis.UniversalOptions{
+		Username:     helper.CONFIG.RedisUsername,
+		Password:     helper.CONFIG.RedisPassword,
+		PoolSize:     helper.CONFIG.RedisPoolMaxIdle,
+		DialTimeout:  time.Duration(helper.CONFIG.RedisConnectTimeout) * time.Second,
+		ReadTimeout:  time.Duration(helper.CONFIG.RedisReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(helper.CONFIG.RedisWriteTimeout) * time.Second,
+		TLSConfig:    tc,
+	}
+
+	switch helper.CONFIG.RedisMode {
+	case ModeSentinel:
+		opts.MasterName = helper.CONFIG.RedisSentinelMasterName
+		opts.Addrs = helper.CONFIG.RedisSentinelAddresses
+	case ModeCluster:
+		opts.Addrs = helper.CONFIG.RedisClusterAddresses
+	default:
+		opts.Addrs = []string{helper.CONFIG.RedisAddress}
 	}
+
+	client = redis.NewUniversalClient(opts)
+
+	startInvalidationSubscriber()
+	initLocalCache()
 }
 
-func Pool() *redigo.Pool {
-	return redisPool
+// RegisterInvalidationHandler registers fn to be called with the key from
+// every Invalid() message published for table, including ones published by
+// other yig instances. It lets bucket/object/user caches drop their
+// in-process entries the moment another instance mutates the underlying
+// state. Handlers are called synchronously from the subscriber goroutine, so
+// they must not block.
+func RegisterInvalidationHandler(table RedisDatabase, fn func(key string)) {
+	invalidHandlersMu.Lock()
+	defer invalidHandlersMu.Unlock()
+	invalidHandlers[table] = append(invalidHandlers[table], fn)
 }
 
-func Close() {
-	err := redisPool.Close()
-	if err != nil {
-		helper.ErrorIf(err, "Cannot close redis pool.")
+// startInvalidationSubscriber subscribes to every MetadataTables'
+// InvalidQueue() channel on a dedicated connection (pub/sub connections are
+// stateful and must not be shared with the command pool) and dispatches
+// incoming keys to the handlers registered via RegisterInvalidationHandler.
+// The go-redis client already reconnects and re-subscribes this PubSub with
+// backoff if the underlying connection drops.
+func startInvalidationSubscriber() {
+	channels := make([]string, 0, len(MetadataTables))
+	tableForChannel := make(map[string]RedisDatabase, len(MetadataTables))
+	for _, table := range MetadataTables {
+		channels = append(channels, table.InvalidQueue())
+		tableForChannel[table.InvalidQueue()] = table
 	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	invalidCancel = cancel
+	invalidPubSub = client.Subscribe(ctx, channels...)
+
+	go func() {
+		for msg := range invalidPubSub.Channel() {
+			table, ok := tableForChannel[msg.Channel]
+			if !ok {
+				continue
+			}
+			invalidHandlersMu.Lock()
+			handlers := invalidHandlers[table]
+			invalidHandlersMu.Unlock()
+			for _, fn := range handlers {
+				fn(msg.Payload)
+			}
+		}
+	}()
 }
 
-func GetClient(ctx context.Context) (redigo.Conn, error) {
-	return redisPool.GetContext(ctx)
+// Client returns the shared go-redis client, for callers that need to issue
+// commands this package doesn't wrap directly.
+func Client() redis.UniversalClient {
+	return client
 }
 
-func Remove(table RedisDatabase, key string) (err error) {
+func Close() {
+	if invalidCancel != nil {
+		invalidCancel()
+	}
+	if invalidPubSub != nil {
+		if err := invalidPubSub.Close(); err != nil {
+			helper.ErrorIf(err, "Cannot close redis invalidation subscriber.")
+		}
+	}
+	err := client.Close()
+	if err != nil {
+		helper.ErrorIf(err, "Cannot close redis client.")
+	}
+}
+
+func Remove(ctx context.Context, table RedisDatabase, key string) (err error) {
 	return CacheCircuit.Execute(
-		context.Background(),
+		ctx,
 		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
-			defer c.Close()
 			// Use table.String() + key as Redis key
-			_, err = c.Do("DEL", table.String()+key)
-			if err == redigo.ErrNil {
+			err = client.Del(ctx, table.String()+key).Err()
+			if err == redis.Nil {
 				return nil
 			}
 			helper.ErrorIf(err, "Cmd: %s. Key: %s.", "DEL", table.String()+key)
@@ -105,25 +212,20 @@ func Remove(table RedisDatabase, key string) (err error) {
 	)
 }
 
-func Set(table RedisDatabase, key string, value interface{}) (err error) {
+func Set(ctx context.Context, table RedisDatabase, key string, value interface{}) (err error) {
 	return CacheCircuit.Execute(
-		context.Background(),
+		ctx,
 		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
-			defer c.Close()
 			encodedValue, err := helper.MsgPackMarshal(value)
 			if err != nil {
 				return err
 			}
 			// Use table.String() + key as Redis key. Set expire time to 30s.
-			r, err := redigo.String(c.Do("SET", table.String()+key, string(encodedValue), "EX", 30))
-			if err == redigo.ErrNil {
+			err = client.Set(ctx, table.String()+key, string(encodedValue), 30*time.Second).Err()
+			if err == redis.Nil {
 				return nil
 			}
-			helper.ErrorIf(err, "Cmd: %s. Key: %s. Value: %s. Reply: %s.", "SET", table.String()+key, string(encodedValue), r)
+			helper.ErrorIf(err, "Cmd: %s. Key: %s. Value: %s.", "SET", table.String()+key, string(encodedValue))
 			return err
 		},
 		nil,
@@ -131,28 +233,27 @@ func Set(table RedisDatabase, key string, value interface{}) (err error) {
 
 }
 
-func Get(table RedisDatabase, key string,
+func Get(ctx context.Context, table RedisDatabase, key string,
 	unmarshal func([]byte) (interface{}, error)) (value interface{}, err error) {
-	var encodedValue []byte
-	err = CacheCircuit.Execute(
-		context.Background(),
-		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
-			// Use table.String() + key as Redis key
-			encodedValue, err = redigo.Bytes(c.Do("GET", table.String()+key))
-			if err != nil {
-				if err == redigo.ErrNil {
-					return nil
+	cacheKey := table.String() + key
+	encodedValue, err := cachedFetch(cacheKey, func() ([]byte, error) {
+		var v []byte
+		err := CacheCircuit.Execute(
+			ctx,
+			func(ctx context.Context) (err error) {
+				v, err = client.Get(ctx, cacheKey).Bytes()
+				if err != nil {
+					if err == redis.Nil {
+						return nil
+					}
+					return err
 				}
-				return err
-			}
-			return nil
-		},
-		nil,
-	)
+				return nil
+			},
+			nil,
+		)
+		return v, err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -162,72 +263,17 @@ func Get(table RedisDatabase, key string,
 	return unmarshal(encodedValue)
 }
 
-// Get file bytes
-// `start` and `end` are inclusive
-// FIXME: this API causes an extra memory copy, need to patch radix to fix it
-func GetBytes(key string, start int64, end int64) ([]byte, error) {
-	var value []byte
-	err := CacheCircuit.Execute(
-		context.Background(),
-		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
-			// Use table.String() + key as Redis key
-			value, err = redigo.Bytes(c.Do("GETRANGE", FileTable.String()+key, start, end))
-			if err != nil {
-				if err == redigo.ErrNil {
-					return nil
-				}
-				return err
-			}
-			return nil
-		},
-		nil,
-	)
-	if err != nil {
-		return nil, err
-	}
-	return value, nil
-}
-
-// Set file bytes
-func SetBytes(key string, value []byte) (err error) {
-	return CacheCircuit.Execute(
-		context.Background(),
-		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
-			// Use table.String() + key as Redis key
-			r, err := redigo.String(c.Do("SET", FileTable.String()+key, value))
-			if err == redigo.ErrNil {
-				return nil
-			}
-			helper.ErrorIf(err, "Cmd: %s. Key: %s. Value: %s. Reply: %s.", "SET", FileTable.String()+key, string(value), r)
-			return err
-		},
-		nil,
-	)
-}
-
 // Publish the invalid message to other YIG instances through Redis
-func Invalid(table RedisDatabase, key string) (err error) {
+func Invalid(ctx context.Context, table RedisDatabase, key string) (err error) {
 	return CacheCircuit.Execute(
-		context.Background(),
+		ctx,
 		func(ctx context.Context) (err error) {
-			c, err := GetClient(ctx)
-			if err != nil {
-				return err
-			}
 			// Use table.String() + key as Redis key
-			r, err := redigo.String(c.Do("PUBLISH", table.InvalidQueue(), key))
-			if err == redigo.ErrNil {
+			err = client.Publish(ctx, table.InvalidQueue(), key).Err()
+			if err == redis.Nil {
 				return nil
 			}
-			helper.ErrorIf(err, "Cmd: %s. Queue: %s. Key: %s. Reply: %s.", "PUBLISH", table.InvalidQueue(), FileTable.String()+key, r)
+			helper.ErrorIf(err, "Cmd: %s. Queue: %s. Key: %s.", "PUBLISH", table.InvalidQueue(), FileTable.String()+key)
 			return err
 		},
 		nil,